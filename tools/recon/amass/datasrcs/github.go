@@ -0,0 +1,319 @@
+// Copyright 2017-2020 Jeff Foley. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package datasrcs
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/OWASP/Amass/v3/requests"
+	"github.com/caffix/eventbus"
+	"github.com/caffix/stringset"
+)
+
+const githubCodeSearchURL = "https://api.github.com/search/code"
+
+// GitHub is a data source that discovers subdomains by running GitHub code
+// searches for the target domain and scraping the matched source snippets.
+type GitHub struct {
+	sync.Mutex
+
+	bus      *eventbus.EventBus
+	client   *http.Client
+	tokens   []string
+	next     int
+	searched *stringset.Set
+
+	blockedUntil time.Time
+}
+
+// NewGitHub returns an initialized GitHub data source using the provided API tokens.
+func NewGitHub(bus *eventbus.EventBus, tokens []string) *GitHub {
+	return &GitHub{
+		bus:      bus,
+		client:   http.DefaultClient,
+		tokens:   tokens,
+		searched: stringset.New(),
+	}
+}
+
+// Close releases resources held by the data source.
+func (g *GitHub) Close() {
+	g.searched.Close()
+}
+
+// Request performs a GitHub code search for the domain named in req and
+// publishes every subdomain discovered in the results onto the event bus.
+// subdomainTask.OutputRequests dispatches a request to every source for
+// every resolved/subdomain name under a domain, so this only lets the first
+// dispatch for a given domain run a search; repeats are a no-op.
+func (g *GitHub) Request(ctx context.Context, req requests.Request) {
+	if len(g.tokens) == 0 {
+		return
+	}
+
+	domain := domainFromRequest(req)
+	if domain == "" || g.alreadySearched(domain) {
+		return
+	}
+
+	re, err := subdomainPattern(domain)
+	if err != nil {
+		return
+	}
+
+	seen := stringset.New()
+	defer seen.Close()
+
+	next := githubCodeSearchURL + "?q=" + url.QueryEscape(domain) + "&per_page=100"
+	for next != "" {
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
+
+		items, link, err := g.searchPage(ctx, next)
+		if err != nil {
+			return
+		}
+
+		for _, item := range items {
+			for _, name := range g.namesInItem(ctx, item, re) {
+				name = strings.ToLower(name)
+				if seen.Has(name) {
+					continue
+				}
+				seen.Insert(name)
+
+				g.bus.Publish(requests.NewNameTopic, eventbus.PriorityHigh, &requests.DNSRequest{
+					Name:   name,
+					Domain: domain,
+					Tag:    requests.API,
+					Source: "GitHub",
+				})
+			}
+		}
+
+		next = link
+	}
+}
+
+// alreadySearched reports whether domain has already been (or is already
+// being) searched, marking it as searched if not.
+func (g *GitHub) alreadySearched(domain string) bool {
+	g.Lock()
+	defer g.Unlock()
+
+	if g.searched.Has(domain) {
+		return true
+	}
+	g.searched.Insert(domain)
+	return false
+}
+
+// domainFromRequest extracts the root domain from the requests the
+// subdomainTask output loop dispatches to data sources.
+func domainFromRequest(req requests.Request) string {
+	switch v := req.(type) {
+	case *requests.ResolvedRequest:
+		return v.Domain
+	case *requests.SubdomainRequest:
+		return v.Domain
+	default:
+		return ""
+	}
+}
+
+// subdomainPattern builds the regex used to pull subdomains of domain out of
+// arbitrary source text.
+func subdomainPattern(domain string) (*regexp.Regexp, error) {
+	return regexp.Compile(`[a-zA-Z0-9._-]+\.` + regexp.QuoteMeta(domain))
+}
+
+type githubCodeItem struct {
+	Path        string `json:"path"`
+	HTMLURL     string `json:"html_url"`
+	TextMatches []struct {
+		Fragment string `json:"fragment"`
+	} `json:"text_matches"`
+}
+
+type githubCodeSearchResp struct {
+	Items []githubCodeItem `json:"items"`
+}
+
+// searchPage performs a single page of the GitHub code search, rotating API
+// tokens on rate-limit responses, and returns the items found along with the
+// URL of the next page, if any.
+func (g *GitHub) searchPage(ctx context.Context, u string) ([]githubCodeItem, string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	req.Header.Set("Accept", "application/vnd.github.v3.text-match+json")
+
+	resp, err := g.doWithToken(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var parsed githubCodeSearchResp
+	if err := json.Unmarshal(body, &parsed); err != nil {
+		return nil, "", err
+	}
+
+	return parsed.Items, nextPageURL(resp.Header.Get("Link")), nil
+}
+
+// doWithToken issues req using the current token, rotating to the next token
+// when the current one is rate-limited and, once every token has been
+// rate-limited in turn, sleeping until the reported reset time.
+func (g *GitHub) doWithToken(req *http.Request) (*http.Response, error) {
+	for {
+		if err := g.waitForToken(req.Context()); err != nil {
+			return nil, err
+		}
+
+		token := g.currentToken()
+		r := req.Clone(req.Context())
+		r.Header.Set("Authorization", "token "+token)
+
+		resp, err := g.client.Do(r)
+		if err != nil {
+			return nil, err
+		}
+
+		if resp.StatusCode == http.StatusForbidden && resp.Header.Get("X-RateLimit-Remaining") == "0" {
+			resp.Body.Close()
+			g.rotateToken(resp.Header.Get("X-RateLimit-Reset"))
+			continue
+		}
+
+		return resp, nil
+	}
+}
+
+// waitForToken blocks until any previously recorded rate-limit window has passed.
+func (g *GitHub) waitForToken(ctx context.Context) error {
+	g.Lock()
+	wait := time.Until(g.blockedUntil)
+	g.Unlock()
+
+	if wait <= 0 {
+		return nil
+	}
+
+	t := time.NewTimer(wait)
+	defer t.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// currentToken returns the API token the next request should use.
+func (g *GitHub) currentToken() string {
+	g.Lock()
+	defer g.Unlock()
+
+	return g.tokens[g.next%len(g.tokens)]
+}
+
+// rotateToken advances to the next configured token and, once all tokens
+// have been tried, records the reset time so future requests wait it out.
+func (g *GitHub) rotateToken(reset string) {
+	g.Lock()
+	defer g.Unlock()
+
+	g.next++
+	if g.next%len(g.tokens) == 0 {
+		if secs, err := strconv.ParseInt(reset, 10, 64); err == nil {
+			g.blockedUntil = time.Unix(secs, 0)
+		}
+	}
+}
+
+var linkNextRE = regexp.MustCompile(`<([^>]+)>;\s*rel="next"`)
+
+// nextPageURL extracts the "next" relation from a GitHub Link header.
+func nextPageURL(link string) string {
+	matches := linkNextRE.FindStringSubmatch(link)
+	if len(matches) != 2 {
+		return ""
+	}
+	return matches[1]
+}
+
+// namesInItem extracts subdomain matches from the item's text match
+// fragments, falling back to fetching the raw file when none are present.
+func (g *GitHub) namesInItem(ctx context.Context, item githubCodeItem, re *regexp.Regexp) []string {
+	var names []string
+
+	for _, m := range item.TextMatches {
+		names = append(names, re.FindAllString(m.Fragment, -1)...)
+	}
+	if len(names) > 0 || item.HTMLURL == "" {
+		return names
+	}
+
+	content, err := g.fetchRawFile(ctx, item.HTMLURL)
+	if err != nil {
+		return nil
+	}
+	return re.FindAllString(content, -1)
+}
+
+// fetchRawFile downloads the raw content behind a GitHub blob URL.
+func (g *GitHub) fetchRawFile(ctx context.Context, htmlURL string) (string, error) {
+	raw := strings.Replace(htmlURL, "github.com", "raw.githubusercontent.com", 1)
+	raw = strings.Replace(raw, "/blob/", "/", 1)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, raw, nil)
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := g.doWithToken(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status fetching %s: %d", raw, resp.StatusCode)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+
+	// The content may itself be base64 encoded when served from the API
+	// instead of the raw host; attempt to decode it, falling back to the
+	// content as-is when that fails.
+	if decoded, err := base64.StdEncoding.DecodeString(string(body)); err == nil {
+		return string(decoded), nil
+	}
+	return string(body), nil
+}
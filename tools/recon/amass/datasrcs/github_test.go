@@ -0,0 +1,205 @@
+// Copyright 2017-2020 Jeff Foley. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package datasrcs
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/OWASP/Amass/v3/requests"
+	"github.com/caffix/eventbus"
+)
+
+// roundTripFunc lets a plain function act as an http.RoundTripper for mocking.
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+func newRecordingBody(s string) *recordingBody {
+	return &recordingBody{s: s}
+}
+
+type recordingBody struct {
+	s   string
+	pos int
+}
+
+func (b *recordingBody) Read(p []byte) (int, error) {
+	if b.pos >= len(b.s) {
+		return 0, io.EOF
+	}
+	n := copy(p, b.s[b.pos:])
+	b.pos += n
+	return n, nil
+}
+
+func (b *recordingBody) Close() error { return nil }
+
+func TestRotateTokenOnRateLimit(t *testing.T) {
+	var calls int
+
+	g := NewGitHub(eventbus.NewEventBus(), []string{"token-one", "token-two"})
+	g.client = &http.Client{
+		Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+			calls++
+			auth := r.Header.Get("Authorization")
+
+			if auth == "token token-one" {
+				resp := &http.Response{
+					StatusCode: http.StatusForbidden,
+					Header:     make(http.Header),
+					Body:       newRecordingBody(""),
+				}
+				resp.Header.Set("X-RateLimit-Remaining", "0")
+				resp.Header.Set("X-RateLimit-Reset", strconv.FormatInt(time.Now().Add(time.Millisecond).Unix(), 10))
+				return resp, nil
+			}
+
+			resp := &http.Response{
+				StatusCode: http.StatusOK,
+				Header:     make(http.Header),
+				Body:       newRecordingBody(`{"items":[]}`),
+			}
+			return resp, nil
+		}),
+	}
+
+	req, err := http.NewRequest(http.MethodGet, githubCodeSearchURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := g.doWithToken(req)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected the retry on the second token to succeed, got status %d", resp.StatusCode)
+	}
+	if calls != 2 {
+		t.Fatalf("expected exactly one rate-limited call and one retry, got %d calls", calls)
+	}
+}
+
+func TestNextPageURL(t *testing.T) {
+	link := `<https://api.github.com/search/code?q=x&page=2>; rel="next", <https://api.github.com/search/code?q=x&page=5>; rel="last"`
+
+	if got := nextPageURL(link); got != "https://api.github.com/search/code?q=x&page=2" {
+		t.Fatalf("unexpected next page URL: %q", got)
+	}
+	if got := nextPageURL(""); got != "" {
+		t.Fatalf("expected no next page URL for an empty Link header, got %q", got)
+	}
+}
+
+func TestDomainFromRequest(t *testing.T) {
+	if got := domainFromRequest(&requests.ResolvedRequest{Domain: "example.com"}); got != "example.com" {
+		t.Errorf("unexpected domain for ResolvedRequest: %q", got)
+	}
+	if got := domainFromRequest(&requests.SubdomainRequest{Domain: "example.org"}); got != "example.org" {
+		t.Errorf("unexpected domain for SubdomainRequest: %q", got)
+	}
+	if got := domainFromRequest(&requests.DNSRequest{Domain: "example.net"}); got != "" {
+		t.Errorf("expected an unsupported request type to yield no domain, got %q", got)
+	}
+}
+
+func TestRequestSkipsAlreadySearchedDomain(t *testing.T) {
+	var calls int
+
+	g := NewGitHub(eventbus.NewEventBus(), []string{"token"})
+	g.client = &http.Client{
+		Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+			calls++
+			return &http.Response{
+				StatusCode: http.StatusOK,
+				Header:     make(http.Header),
+				Body:       newRecordingBody(`{"items":[]}`),
+			}, nil
+		}),
+	}
+
+	req := &requests.SubdomainRequest{Domain: "example.com"}
+	g.Request(context.Background(), req)
+	if calls != 1 {
+		t.Fatalf("expected the first dispatch to search GitHub once, got %d calls", calls)
+	}
+
+	g.Request(context.Background(), req)
+	if calls != 1 {
+		t.Fatalf("expected a repeat dispatch for the same domain to be a no-op, got %d calls", calls)
+	}
+
+	other := &requests.ResolvedRequest{Domain: "other.com"}
+	g.Request(context.Background(), other)
+	if calls != 2 {
+		t.Fatalf("expected a dispatch for a different domain to search GitHub again, got %d calls", calls)
+	}
+}
+
+func TestRequestPublishesDiscoveredNames(t *testing.T) {
+	bus := eventbus.NewEventBus()
+
+	var mu sync.Mutex
+	var got []*requests.DNSRequest
+	bus.Subscribe(requests.NewNameTopic, func(req *requests.DNSRequest) {
+		mu.Lock()
+		defer mu.Unlock()
+		got = append(got, req)
+	})
+
+	g := NewGitHub(bus, []string{"token"})
+	g.client = &http.Client{
+		Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+			body := `{"items":[{"path":"config.env","html_url":"",` +
+				`"text_matches":[{"fragment":"API_HOST=api.example.com"}]}]}`
+			return &http.Response{
+				StatusCode: http.StatusOK,
+				Header:     make(http.Header),
+				Body:       newRecordingBody(body),
+			}, nil
+		}),
+	}
+
+	g.Request(context.Background(), &requests.SubdomainRequest{Domain: "example.com"})
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(got) != 1 {
+		t.Fatalf("expected 1 DNSRequest published, got %d", len(got))
+	}
+	if got[0].Name != "api.example.com" {
+		t.Errorf("expected the discovered subdomain api.example.com, got %q", got[0].Name)
+	}
+}
+
+func TestNamesInItemExtractsFragmentMatches(t *testing.T) {
+	g := NewGitHub(eventbus.NewEventBus(), []string{"token"})
+	re, err := subdomainPattern("example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	item := githubCodeItem{
+		TextMatches: []struct {
+			Fragment string `json:"fragment"`
+		}{
+			{Fragment: "API_HOST=api.example.com some other text cdn.example.com"},
+		},
+	}
+
+	names := g.namesInItem(context.Background(), item, re)
+	if len(names) != 2 {
+		t.Fatalf("expected 2 subdomains extracted from the fragment, got %d: %v", len(names), names)
+	}
+}
@@ -5,15 +5,18 @@ package enum
 
 import (
 	"context"
+	"math/rand"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/OWASP/Amass/v3/requests"
+	"github.com/OWASP/Amass/v3/resolve"
 	"github.com/OWASP/Amass/v3/stringfilter"
 	"github.com/caffix/pipeline"
 	"github.com/caffix/queue"
+	"github.com/caffix/stringset"
 )
 
 // The filter for new outgoing DNS queries
@@ -45,10 +48,10 @@ func (f *fqdnFilter) Process(ctx context.Context, data pipeline.Data, tp pipelin
 	// Clean up the newly discovered name and domain
 	requests.SanitizeDNSRequest(req)
 	// Check that this name has not already been processed
-	return f.checkFilter(req), nil
+	return f.checkFilter(req, tp), nil
 }
 
-func (f *fqdnFilter) checkFilter(req *requests.DNSRequest) *requests.DNSRequest {
+func (f *fqdnFilter) checkFilter(req *requests.DNSRequest, tp pipeline.TaskParams) *requests.DNSRequest {
 	f.Lock()
 	defer f.Unlock()
 
@@ -65,13 +68,15 @@ func (f *fqdnFilter) checkFilter(req *requests.DNSRequest) *requests.DNSRequest
 	// Do not submit names from untrusted sources, after already receiving the name
 	// from a trusted source
 	if !trusted && f.filter.Has(req.Name+strconv.FormatBool(true)) {
-		f.queue.Append(req)
+		tp.Pipeline().IncDataItemCount()
+		f.queue.Append(&dupNameReq{Req: req, TP: tp})
 		return nil
 	}
 	// At most, a FQDN will be accepted from an untrusted source first, and then
 	// reconsidered from a trusted data source
 	if f.filter.Duplicate(req.Name + strconv.FormatBool(trusted)) {
-		f.queue.Append(req)
+		tp.Pipeline().IncDataItemCount()
+		f.queue.Append(&dupNameReq{Req: req, TP: tp})
 		return nil
 	}
 
@@ -79,6 +84,14 @@ func (f *fqdnFilter) checkFilter(req *requests.DNSRequest) *requests.DNSRequest
 	return req
 }
 
+// dupNameReq pairs a deferred duplicate name with the pipeline.TaskParams that
+// originally submitted it, so processDupNames can account for it once it is
+// permanently dropped from the pipeline.
+type dupNameReq struct {
+	Req *requests.DNSRequest
+	TP  pipeline.TaskParams
+}
+
 // This goroutine ensures that duplicate names from other sources are shown in the Graph.
 func (f *fqdnFilter) processDupNames() {
 	uuid := f.enum.Config.UUID.String()
@@ -91,14 +104,17 @@ func (f *fqdnFilter) processDupNames() {
 	}
 	var pending []*altsource
 	each := func(element interface{}) {
-		req := element.(*requests.DNSRequest)
+		dup := element.(*dupNameReq)
 
 		pending = append(pending, &altsource{
-			Name:      req.Name,
-			Source:    req.Source,
-			Tag:       req.Tag,
+			Name:      dup.Req.Name,
+			Source:    dup.Req.Source,
+			Tag:       dup.Req.Tag,
 			Timestamp: time.Now(),
 		})
+		// The name has been handed off to local bookkeeping and will never
+		// re-enter the pipeline, so the pipeline no longer needs to track it.
+		dup.TP.Pipeline().DecDataItemCount()
 	}
 	t := time.NewTicker(5 * time.Second)
 	defer t.Stop()
@@ -132,21 +148,38 @@ loop:
 	}
 }
 
+// wildcardResolver is the subset of resolve.Pool's behavior probeForWildcard
+// needs, narrowed to the point of use so a fake resolver can drive it in
+// tests without the wider Enumeration/resolve.Pool types this tree lacks.
+type wildcardResolver interface {
+	Resolve(ctx context.Context, name, qtype string, priority int) ([]requests.DNSAnswer, error)
+}
+
 // subdomainTask handles newly discovered proper subdomain names in the enumeration.
 type subdomainTask struct {
-	enum      *Enumeration
-	queue     queue.Queue
-	timesChan chan *timesReq
-	done      chan struct{}
+	enum            *Enumeration
+	res             wildcardResolver
+	queue           queue.Queue
+	timesChan       chan *timesReq
+	done            chan struct{}
+	withinWildcards *stringset.Set
+	cnames          *stringset.Set
+
+	apexLock       sync.Mutex
+	possibleApexes map[string]*stringset.Set
 }
 
 // newSubdomainTask returns an initialized SubdomainTask.
 func newSubdomainTask(e *Enumeration) *subdomainTask {
 	r := &subdomainTask{
-		enum:      e,
-		queue:     queue.NewQueue(),
-		timesChan: make(chan *timesReq, 10),
-		done:      make(chan struct{}, 2),
+		enum:            e,
+		res:             e.Sys.Pool(),
+		queue:           queue.NewQueue(),
+		timesChan:       make(chan *timesReq, 10),
+		done:            make(chan struct{}, 2),
+		withinWildcards: stringset.New(),
+		cnames:          stringset.New(),
+		possibleApexes:  make(map[string]*stringset.Set),
 	}
 
 	go r.timesManager()
@@ -156,10 +189,62 @@ func newSubdomainTask(e *Enumeration) *subdomainTask {
 // Stop releases resources allocated by the instance.
 func (r *subdomainTask) Stop() error {
 	close(r.done)
-	r.queue = queue.NewQueue()
+	r.drainQueue()
+	r.withinWildcards.Close()
+	r.cnames.Close()
+	r.linkNodesToApexes()
 	return nil
 }
 
+// drainQueue discards any outputReq items still waiting to be handed to
+// OutputRequests, decrementing the pipeline's in-flight count for each one
+// so that replacing the queue does not leak data items the pipeline is
+// still waiting to see drained.
+func (r *subdomainTask) drainQueue() {
+	old := r.queue
+	r.queue = queue.NewQueue()
+
+	old.Process(func(element interface{}) {
+		out := element.(*outputReq)
+		out.TP.Pipeline().DecDataItemCount()
+	})
+}
+
+// linkNodesToApexes inserts a "node" relation from each domain apex asset to every
+// subdomain discovered directly beneath it, so consumers of the graph can
+// distinguish apex-rooted trees from arbitrary parent/child FQDN relations.
+// Both the in-memory graph and the asset-db backend treat this insert as an
+// upsert, so calling this more than once for the same apex/subdomain pair
+// does not create duplicate edges.
+func (r *subdomainTask) linkNodesToApexes() {
+	uuid := r.enum.Config.UUID.String()
+
+	r.apexLock.Lock()
+	apexes := r.possibleApexes
+	r.possibleApexes = make(map[string]*stringset.Set)
+	r.apexLock.Unlock()
+
+	for apex, subs := range apexes {
+		apexNode, err := r.enum.Graph.ReadNode(apex, "fqdn")
+		if err != nil {
+			subs.Close()
+			continue
+		}
+
+		for _, sub := range subs.Slice() {
+			subNode, err := r.enum.Graph.ReadNode(sub, "fqdn")
+			if err != nil {
+				continue
+			}
+
+			if err := r.enum.Graph.InsertRelation(apexNode, "node", subNode, uuid); err != nil {
+				continue
+			}
+		}
+		subs.Close()
+	}
+}
+
 // Process implements the pipeline Task interface.
 func (r *subdomainTask) Process(ctx context.Context, data pipeline.Data, tp pipeline.TaskParams) (pipeline.Data, error) {
 	req, ok := data.(*requests.DNSRequest)
@@ -178,17 +263,62 @@ func (r *subdomainTask) Process(ctx context.Context, data pipeline.Data, tp pipe
 		}
 	}
 
-	r.queue.Append(&requests.ResolvedRequest{
+	// Drop names whose parent has already been identified as a wildcard subtree
+	if r.inWildcardSubtree(req.Name) {
+		return nil, nil
+	}
+
+	r.trackCNAMEs(req)
+
+	tp.Pipeline().IncDataItemCount()
+	r.queue.Append(&outputReq{Data: &requests.ResolvedRequest{
 		Name:    req.Name,
 		Domain:  req.Domain,
 		Records: append([]requests.DNSAnswer(nil), req.Records...),
 		Tag:     req.Tag,
 		Source:  req.Source,
-	})
+	}, TP: tp})
 
 	return r.checkForSubdomains(ctx, req, tp)
 }
 
+// inWildcardSubtree reports whether name descends from a domain already
+// flagged as wildcarding in withinWildcards.
+func (r *subdomainTask) inWildcardSubtree(name string) bool {
+	labels := strings.Split(name, ".")
+
+	for i := 1; i < len(labels); i++ {
+		if r.withinWildcards.Has(strings.Join(labels[i:], ".")) {
+			return true
+		}
+	}
+	return false
+}
+
+// trackCNAMEs records any CNAME targets found in req so they are never
+// later treated as proper subdomains.
+func (r *subdomainTask) trackCNAMEs(req *requests.DNSRequest) {
+	for _, ans := range req.Records {
+		if strings.EqualFold(ans.Type, "CNAME") {
+			r.cnames.Insert(strings.ToLower(strings.TrimSuffix(ans.Data, ".")))
+		}
+	}
+}
+
+// trackPossibleApex records that name was discovered directly beneath the
+// domain apex, so Stop can later link the two in the graph.
+func (r *subdomainTask) trackPossibleApex(apex, name string) {
+	r.apexLock.Lock()
+	defer r.apexLock.Unlock()
+
+	subs, found := r.possibleApexes[apex]
+	if !found {
+		subs = stringset.New()
+		r.possibleApexes[apex] = subs
+	}
+	subs.Insert(name)
+}
+
 func (r *subdomainTask) checkForSubdomains(ctx context.Context, req *requests.DNSRequest, tp pipeline.TaskParams) (pipeline.Data, error) {
 	labels := strings.Split(req.Name, ".")
 	num := len(labels)
@@ -203,9 +333,13 @@ func (r *subdomainTask) checkForSubdomains(ctx context.Context, req *requests.DN
 
 	sub := strings.TrimSpace(strings.Join(labels[1:], "."))
 	// CNAMEs are not a proper subdomain
-	if r.enum.Graph.IsCNAMENode(sub) {
+	if r.enum.Graph.IsCNAMENode(sub) || r.cnames.Has(sub) {
 		return req, nil
 	}
+	// We saw a name directly under the domain apex
+	if sub == req.Domain {
+		r.trackPossibleApex(req.Domain, req.Name)
+	}
 
 	subreq := &requests.SubdomainRequest{
 		Name:   sub,
@@ -215,14 +349,108 @@ func (r *subdomainTask) checkForSubdomains(ctx context.Context, req *requests.DN
 		Times:  r.timesForSubdomain(sub),
 	}
 
-	r.queue.Append(subreq)
+	tp.Pipeline().IncDataItemCount()
+	r.queue.Append(&outputReq{Data: subreq, TP: tp})
 	// First time this proper subdomain has been seen?
 	if sub != req.Domain && subreq.Times == 1 {
-		go pipeline.SendData(ctx, "root", subreq, tp)
+		if r.probeForWildcard(ctx, sub) {
+			r.withinWildcards.Insert(sub)
+		} else {
+			tp.Pipeline().IncDataItemCount()
+			go func() {
+				defer tp.Pipeline().DecDataItemCount()
+				pipeline.SendData(ctx, "root", subreq, tp)
+			}()
+		}
 	}
 	return req, nil
 }
 
+// outputReq pairs an item bound for OutputRequests with the pipeline.TaskParams
+// that deferred it, so the pipeline's in-flight item count stays accurate
+// until the item is handed off to the enumeration's data sources.
+type outputReq struct {
+	Data pipeline.Data
+	TP   pipeline.TaskParams
+}
+
+// probeForWildcard issues a pair of random-label A/AAAA queries under sub and
+// reports whether both resolve to the same answer set, indicating a wildcard.
+func (r *subdomainTask) probeForWildcard(ctx context.Context, sub string) bool {
+	first, err := r.resolveRandomLabel(ctx, sub)
+	if err != nil || len(first) == 0 {
+		return false
+	}
+
+	second, err := r.resolveRandomLabel(ctx, sub)
+	if err != nil || len(second) == 0 {
+		return false
+	}
+
+	return sameAnswers(first, second)
+}
+
+// resolveRandomLabel queries both A and AAAA for a random label under sub, so
+// that an IPv6-only wildcard subtree is detected just as an IPv4-only one is.
+func (r *subdomainTask) resolveRandomLabel(ctx context.Context, sub string) ([]requests.DNSAnswer, error) {
+	name := randomLabel() + "." + sub
+
+	var answers []requests.DNSAnswer
+	var lastErr error
+	for _, qtype := range []string{"A", "AAAA"} {
+		ans, err := r.res.Resolve(ctx, name, qtype, resolve.PriorityLow)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		answers = append(answers, ans...)
+	}
+
+	if len(answers) == 0 {
+		return nil, lastErr
+	}
+	return answers, nil
+}
+
+// randomLabel returns a random DNS label used to probe for wildcard behavior.
+func randomLabel() string {
+	const chars = "abcdefghijklmnopqrstuvwxyz0123456789"
+
+	b := make([]byte, 12)
+	for i := range b {
+		b[i] = chars[rand.Intn(len(chars))]
+	}
+	return string(b)
+}
+
+// sameAnswers reports whether two answer sets resolve to the same addresses.
+func sameAnswers(a, b []requests.DNSAnswer) bool {
+	if len(a) == 0 || len(a) != len(b) {
+		return false
+	}
+
+	seen := make(map[string]struct{}, len(a))
+	for _, ans := range a {
+		seen[ans.Data] = struct{}{}
+	}
+	for _, ans := range b {
+		if _, ok := seen[ans.Data]; !ok {
+			return false
+		}
+	}
+	// Either set may repeat an address, so also check a's addresses against b.
+	inB := make(map[string]struct{}, len(b))
+	for _, ans := range b {
+		inB[ans.Data] = struct{}{}
+	}
+	for _, ans := range a {
+		if _, ok := inB[ans.Data]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
 // OutputRequests sends discovered subdomain names to the enumeration data sources.
 func (r *subdomainTask) OutputRequests(num int) int {
 	if num <= 0 {
@@ -237,8 +465,13 @@ loop:
 			break
 		}
 
+		out := element.(*outputReq)
+		// The item has been handed off to the data sources and will not
+		// re-enter the pipeline, so it is no longer in-flight.
+		out.TP.Pipeline().DecDataItemCount()
+
 		for _, src := range r.enum.srcs {
-			switch v := element.(type) {
+			switch v := out.Data.(type) {
 			case *requests.ResolvedRequest:
 				src.Request(r.enum.ctx, v.Clone())
 			case *requests.SubdomainRequest:
@@ -0,0 +1,206 @@
+// Copyright 2017-2020 Jeff Foley. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package enum
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/OWASP/Amass/v3/requests"
+	"github.com/OWASP/Amass/v3/stringfilter"
+	"github.com/caffix/pipeline"
+	"github.com/caffix/queue"
+	"github.com/caffix/stringset"
+)
+
+// fakeTaskParams is a minimal pipeline.TaskParams used to exercise the
+// data-item counting calls made by checkFilter without a real pipeline.
+type fakeTaskParams struct {
+	pl *pipeline.Pipeline
+}
+
+func (f *fakeTaskParams) Pipeline() *pipeline.Pipeline {
+	return f.pl
+}
+
+// fakeWildcardResolver is a stubbed wildcardResolver that returns a fixed
+// answer set for every query regardless of the random label asked for,
+// simulating a DNS wildcard subtree. A nil answer simulates a subtree where
+// random labels never resolve.
+type fakeWildcardResolver struct {
+	answer []requests.DNSAnswer
+}
+
+func (f *fakeWildcardResolver) Resolve(ctx context.Context, name, qtype string, priority int) ([]requests.DNSAnswer, error) {
+	if f.answer == nil {
+		return nil, errors.New("NXDOMAIN")
+	}
+	return f.answer, nil
+}
+
+func TestProbeForWildcardDetectsWildcardSubtree(t *testing.T) {
+	r := &subdomainTask{res: &fakeWildcardResolver{
+		answer: []requests.DNSAnswer{{Type: "A", Data: "192.0.2.1"}},
+	}}
+
+	if !r.probeForWildcard(context.Background(), "wildcard.example.com") {
+		t.Fatal("expected two random labels that resolve to the same answer to be reported as a wildcard")
+	}
+}
+
+func TestProbeForWildcardIgnoresOrdinarySubtree(t *testing.T) {
+	r := &subdomainTask{res: &fakeWildcardResolver{}}
+
+	if r.probeForWildcard(context.Background(), "example.com") {
+		t.Fatal("expected a subtree whose random labels never resolve to not be reported as a wildcard")
+	}
+}
+
+func TestInWildcardSubtreeSuppressesSiblings(t *testing.T) {
+	r := &subdomainTask{withinWildcards: stringset.New(), cnames: stringset.New()}
+	defer r.withinWildcards.Close()
+	defer r.cnames.Close()
+
+	r.withinWildcards.Insert("wildcard.example.com")
+
+	cases := map[string]bool{
+		"one.wildcard.example.com": true,
+		"two.wildcard.example.com": true,
+		"wildcard.example.com":     false,
+		"other.example.com":        false,
+		"example.com":              false,
+	}
+	for name, want := range cases {
+		if got := r.inWildcardSubtree(name); got != want {
+			t.Errorf("inWildcardSubtree(%q) = %v, want %v", name, got, want)
+		}
+	}
+}
+
+func TestTrackCNAMEsAddsTargets(t *testing.T) {
+	r := &subdomainTask{withinWildcards: stringset.New(), cnames: stringset.New()}
+	defer r.withinWildcards.Close()
+	defer r.cnames.Close()
+
+	req := &requests.DNSRequest{
+		Name: "www.example.com",
+		Records: []requests.DNSAnswer{
+			{Type: "CNAME", Data: "edge.example.net."},
+		},
+	}
+
+	r.trackCNAMEs(req)
+
+	if !r.cnames.Has("edge.example.net") {
+		t.Fatal("expected the CNAME target to be tracked")
+	}
+}
+
+// linkNodesToApexes itself is still not exercised by an integration test
+// here, and unlike probeForWildcard above (or sweepIPs in sweep_test.go) it isn't a case where
+// narrowing the dependency to an interface and faking it is a reasonable
+// next step: ReadNode's return type is never referenced anywhere else in
+// this source tree, so there is no way to name it in a narrow interface
+// without guessing both an import path and a type for the real graph
+// package behind r.enum.Graph - a guess that could compile here against a
+// hand-rolled fake while still being wrong for the actual Graph this runs
+// against elsewhere. Absent that type, this stays limited to the
+// bookkeeping covered below.
+func TestTrackPossibleApexGroupsSubdomainsByApex(t *testing.T) {
+	r := &subdomainTask{possibleApexes: make(map[string]*stringset.Set)}
+
+	r.trackPossibleApex("example.com", "www.example.com")
+	r.trackPossibleApex("example.com", "mail.example.com")
+	r.trackPossibleApex("example.com", "www.example.com")
+
+	subs, found := r.possibleApexes["example.com"]
+	if !found {
+		t.Fatal("expected an entry for the domain apex")
+	}
+	if l := subs.Len(); l != 2 {
+		t.Fatalf("expected 2 distinct subdomains under the apex, got %d", l)
+	}
+	subs.Close()
+}
+
+func TestCheckFilterDefersDuplicatesUntilDrained(t *testing.T) {
+	f := &fqdnFilter{
+		filter: stringfilter.NewBloomFilter(filterMaxSize),
+		queue:  queue.NewQueue(),
+	}
+	tp := &fakeTaskParams{pl: pipeline.NewPipeline()}
+
+	names := []string{"a.example.com", "a.example.com", "b.example.com"}
+	var accepted int
+	for _, name := range names {
+		req := &requests.DNSRequest{Name: name, Domain: "example.com", Tag: requests.DNS}
+		if out := f.checkFilter(req, tp); out != nil {
+			accepted++
+		}
+	}
+
+	if accepted != 2 {
+		t.Fatalf("expected 2 names accepted on first sighting, got %d", accepted)
+	}
+	if tp.pl.DataItemCount() != 1 {
+		t.Fatalf("expected 1 deferred duplicate tracked by the pipeline, got %d", tp.pl.DataItemCount())
+	}
+
+	var drained int
+	f.queue.Process(func(element interface{}) {
+		dup := element.(*dupNameReq)
+		dup.TP.Pipeline().DecDataItemCount()
+		drained++
+	})
+
+	if drained != 1 {
+		t.Fatalf("expected 1 duplicate drained from the internal queue, got %d", drained)
+	}
+	if tp.pl.DataItemCount() != 0 {
+		t.Fatalf("expected the pipeline to show no in-flight items after draining, got %d", tp.pl.DataItemCount())
+	}
+}
+
+func TestDrainQueueDecrementsInFlightItems(t *testing.T) {
+	r := &subdomainTask{queue: queue.NewQueue()}
+	tp := &fakeTaskParams{pl: pipeline.NewPipeline()}
+
+	for i := 0; i < 3; i++ {
+		tp.pl.IncDataItemCount()
+		r.queue.Append(&outputReq{Data: &requests.ResolvedRequest{Name: "example.com"}, TP: tp})
+	}
+	if got := tp.pl.DataItemCount(); got != 3 {
+		t.Fatalf("expected 3 in-flight items before draining, got %d", got)
+	}
+
+	old := r.queue
+	r.drainQueue()
+
+	if r.queue == old {
+		t.Fatal("expected drainQueue to replace the queue")
+	}
+	if got := tp.pl.DataItemCount(); got != 0 {
+		t.Fatalf("expected no in-flight items left after draining, got %d", got)
+	}
+	if _, ok := r.queue.Next(); ok {
+		t.Fatal("expected the replacement queue to be empty")
+	}
+}
+
+func TestSameAnswers(t *testing.T) {
+	a := []requests.DNSAnswer{{Data: "192.0.2.1"}, {Data: "192.0.2.2"}}
+	b := []requests.DNSAnswer{{Data: "192.0.2.2"}, {Data: "192.0.2.1"}}
+	c := []requests.DNSAnswer{{Data: "192.0.2.3"}}
+
+	if !sameAnswers(a, b) {
+		t.Error("expected identical answer sets (in any order) to match")
+	}
+	if sameAnswers(a, c) {
+		t.Error("expected different answer sets to not match")
+	}
+	if sameAnswers(nil, nil) {
+		t.Error("expected empty answer sets to never be considered a wildcard match")
+	}
+}
@@ -0,0 +1,206 @@
+// Copyright 2017-2020 Jeff Foley. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package enum
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"sync"
+
+	"github.com/OWASP/Amass/v3/requests"
+	"github.com/caffix/pipeline"
+	"github.com/caffix/queue"
+	boom "github.com/tylertreat/BoomFilters"
+)
+
+const (
+	// Default and active-mode sizes of the CIDR window swept around a resolved address
+	// when the ASN/prefix for that address is not already known.
+	defaultSweepSize = 250
+	activeSweepSize  = 500
+
+	sweepFilterSize = 1000000
+	sweepFilterFP   = 0.01
+)
+
+// reverseResolver is the subset of resolve.Pool's behavior sweepAddr needs,
+// narrowed to the point of use so a fake resolver can drive it in tests
+// without the wider Enumeration/resolve.Pool types this tree lacks.
+type reverseResolver interface {
+	WaitOnRateLimit(ctx context.Context) error
+	Reverse(ctx context.Context, addr string, qtype int) (string, error)
+}
+
+// sweepTask performs reverse DNS sweeps of the CIDRs surrounding resolved
+// addresses, feeding any discovered names back into the enumeration
+// pipeline. The window swept around an address with no known ASN/prefix is
+// defaultSweepSize addresses, widened to activeSweepSize once active
+// techniques are permitted.
+type sweepTask struct {
+	enum   *Enumeration
+	res    reverseResolver
+	queue  queue.Queue
+	filter *boom.StableBloomFilter
+	sync.Mutex
+}
+
+// newSweepTask returns an initialized sweepTask ready to be used as a pipeline stage.
+func newSweepTask(e *Enumeration) *sweepTask {
+	return &sweepTask{
+		enum:   e,
+		res:    e.Sys.Pool(),
+		queue:  queue.NewQueue(),
+		filter: boom.NewDefaultStableBloomFilter(sweepFilterSize, sweepFilterFP),
+	}
+}
+
+// Process implements the pipeline Task interface.
+func (r *sweepTask) Process(ctx context.Context, data pipeline.Data, tp pipeline.TaskParams) (pipeline.Data, error) {
+	req, ok := data.(*requests.DNSRequest)
+	if !ok || req == nil {
+		return data, nil
+	}
+
+	size := defaultSweepSize
+	if r.enum.Config.Active {
+		size = activeSweepSize
+	}
+
+	for _, ans := range req.Records {
+		select {
+		case <-ctx.Done():
+			return data, nil
+		default:
+		}
+
+		ip := net.ParseIP(ans.Data)
+		if ip == nil {
+			continue
+		}
+
+		// sweepAddr runs on its own, outside Process's synchronous return,
+		// so the pipeline cannot otherwise tell this data item is still
+		// in flight; count it until the goroutine finishes.
+		tp.Pipeline().IncDataItemCount()
+		go func(addr net.IP) {
+			defer tp.Pipeline().DecDataItemCount()
+			r.sweepAddr(ctx, addr, size, tp)
+		}(ip)
+	}
+
+	return data, nil
+}
+
+// sweepAddr issues PTR queries across the CIDR window surrounding addr, skipping any
+// address that has already been swept according to the task's stable bloom filter.
+// Each sweepTask allocates its own filter; separate sweepTask instances do not
+// share one.
+func (r *sweepTask) sweepAddr(ctx context.Context, addr net.IP, size int, tp pipeline.TaskParams) {
+	r.sweepIPs(ctx, r.sweepWindow(ctx, addr, size), r.enum.Config.WhichDomain, tp)
+}
+
+// sweepIPs issues a PTR query for each of ips in turn, skipping any address
+// already swept according to the task's stable bloom filter, and
+// feeds each successfully resolved name back into the pipeline. whichDomain
+// maps a discovered name to the enumeration domain it belongs under.
+func (r *sweepTask) sweepIPs(ctx context.Context, ips []net.IP, whichDomain func(string) string, tp pipeline.TaskParams) {
+	for _, a := range ips {
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
+
+		if r.duplicate(a.String()) {
+			continue
+		}
+
+		if err := r.res.WaitOnRateLimit(ctx); err != nil {
+			return
+		}
+
+		name, err := r.res.Reverse(ctx, a.String(), 0)
+		if err != nil || name == "" {
+			continue
+		}
+
+		pipeline.SendData(ctx, "root", &requests.DNSRequest{
+			Name:   name,
+			Domain: whichDomain(name),
+			Tag:    requests.DNS,
+			Source: "Reverse DNS",
+		}, tp)
+	}
+}
+
+// duplicate reports whether the address has already been swept during this run,
+// recording it in the stable bloom filter if not.
+func (r *sweepTask) duplicate(ip string) bool {
+	r.Lock()
+	defer r.Unlock()
+
+	return r.filter.TestAndAdd([]byte(ip))
+}
+
+// sweepWindow returns the addresses to PTR-query around addr, preferring the
+// addr's known ASN/prefix and otherwise falling back to a fixed-size window.
+func (r *sweepTask) sweepWindow(ctx context.Context, addr net.IP, size int) []net.IP {
+	if rec, err := r.enum.Sys.Cache.IPRequest(addr.String()); err == nil && rec != nil && rec.CIDRStr != "" {
+		if _, cidr, err := net.ParseCIDR(rec.CIDRStr); err == nil {
+			return ipsInCIDR(cidr, size)
+		}
+	}
+	return ipsAroundAddr(addr, size)
+}
+
+// ipsInCIDR returns up to size addresses contained in cidr, so that a known
+// prefix far broader than the configured window (e.g. a /8) doesn't get
+// swept in its entirety.
+func ipsInCIDR(cidr *net.IPNet, size int) []net.IP {
+	var ips []net.IP
+	for ip := cidr.IP.Mask(cidr.Mask); cidr.Contains(ip) && len(ips) < size; incIP(ip) {
+		next := make(net.IP, len(ip))
+		copy(next, ip)
+		ips = append(ips, next)
+	}
+	return ips
+}
+
+// incIP increments ip in place, treating it as a big-endian counter.
+func incIP(ip net.IP) {
+	for i := len(ip) - 1; i >= 0; i-- {
+		ip[i]++
+		if ip[i] != 0 {
+			break
+		}
+	}
+}
+
+// ipsAroundAddr returns the size addresses forming a window centered on
+// addr, used when no ASN/prefix information is available. The window is not
+// bound to addr's containing /24, so size may exceed 256.
+func ipsAroundAddr(addr net.IP, size int) []net.IP {
+	ip := addr.To4()
+	if ip == nil {
+		// IPv6 sweeps are not currently supported.
+		return nil
+	}
+
+	center := binary.BigEndian.Uint32(ip)
+	start := center - uint32(size/2)
+	if start > center {
+		// The window would underflow below 0.0.0.0; pin it to the start
+		// of the address space instead.
+		start = 0
+	}
+
+	ips := make([]net.IP, 0, size)
+	for i := 0; i < size; i++ {
+		next := make(net.IP, net.IPv4len)
+		binary.BigEndian.PutUint32(next, start+uint32(i))
+		ips = append(ips, next)
+	}
+	return ips
+}
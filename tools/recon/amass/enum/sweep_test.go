@@ -0,0 +1,120 @@
+// Copyright 2017-2020 Jeff Foley. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package enum
+
+// Process and sweepAddr themselves still aren't driven end-to-end: Process
+// reads r.enum.Config.Active and sweepAddr's sweepWindow reads
+// r.enum.Sys.Cache, and the Enumeration type behind r.enum is not part of
+// this source tree. sweepIPs, the part that actually issues PTR queries and
+// applies the dedup filter, takes its resolver through the narrow
+// reverseResolver interface instead of reaching through r.enum, so it is
+// exercised directly below against a fake.
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/caffix/pipeline"
+	boom "github.com/tylertreat/BoomFilters"
+)
+
+// fakeReverseResolver is a stubbed reverseResolver recording every address
+// it was asked to reverse-lookup, so a test can assert on PTR fan-out.
+type fakeReverseResolver struct {
+	reverseCalls []string
+	names        map[string]string
+}
+
+func (f *fakeReverseResolver) WaitOnRateLimit(ctx context.Context) error { return nil }
+
+func (f *fakeReverseResolver) Reverse(ctx context.Context, addr string, qtype int) (string, error) {
+	f.reverseCalls = append(f.reverseCalls, addr)
+	return f.names[addr], nil
+}
+
+func TestSweepIPsFansOutPTRQueriesAndSkipsRepeats(t *testing.T) {
+	fake := &fakeReverseResolver{names: map[string]string{
+		"192.0.2.1": "one.example.com",
+		"192.0.2.2": "two.example.com",
+	}}
+	r := &sweepTask{
+		res:    fake,
+		filter: boom.NewDefaultStableBloomFilter(sweepFilterSize, sweepFilterFP),
+	}
+	tp := &fakeTaskParams{pl: pipeline.NewPipeline()}
+	whichDomain := func(name string) string { return "example.com" }
+	ips := []net.IP{net.ParseIP("192.0.2.1"), net.ParseIP("192.0.2.2")}
+
+	r.sweepIPs(context.Background(), ips, whichDomain, tp)
+	if len(fake.reverseCalls) != 2 {
+		t.Fatalf("expected a PTR query for each address, got %d: %v", len(fake.reverseCalls), fake.reverseCalls)
+	}
+
+	// A second sweep of the same addresses should be a no-op: both are
+	// already recorded in the stable bloom filter from the first sweep.
+	r.sweepIPs(context.Background(), ips, whichDomain, tp)
+	if len(fake.reverseCalls) != 2 {
+		t.Fatalf("expected repeat addresses to be filtered before a PTR query, got %d total calls", len(fake.reverseCalls))
+	}
+}
+
+func TestIpsAroundAddrIsCenteredOnAddr(t *testing.T) {
+	addr := net.ParseIP("192.168.1.10")
+
+	ips := ipsAroundAddr(addr, 250)
+	if len(ips) != 250 {
+		t.Fatalf("expected 250 addresses, got %d", len(ips))
+	}
+	if !ips[0].Equal(net.ParseIP("192.168.0.141")) {
+		t.Errorf("expected the window to start 125 addresses below addr, got %s", ips[0])
+	}
+	if !ips[len(ips)-1].Equal(net.ParseIP("192.168.1.134")) {
+		t.Errorf("expected the window to end 124 addresses above addr, got %s", ips[len(ips)-1])
+	}
+}
+
+func TestIpsAroundAddrNotClampedTo256(t *testing.T) {
+	addr := net.ParseIP("10.0.0.100")
+
+	ips := ipsAroundAddr(addr, 500)
+	if len(ips) != 500 {
+		t.Fatalf("expected the larger, active-mode window size to be honored, got %d addresses", len(ips))
+	}
+}
+
+func TestIpsAroundAddrClampsAtAddressSpaceStart(t *testing.T) {
+	addr := net.ParseIP("0.0.0.10")
+
+	ips := ipsAroundAddr(addr, 250)
+	if len(ips) != 250 {
+		t.Fatalf("expected 250 addresses, got %d", len(ips))
+	}
+	if !ips[0].Equal(net.ParseIP("0.0.0.0")) {
+		t.Errorf("expected the window to pin to the start of the address space, got %s", ips[0])
+	}
+}
+
+func TestIpsInCIDRCapsAtSize(t *testing.T) {
+	_, cidr, err := net.ParseCIDR("10.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ips := ipsInCIDR(cidr, defaultSweepSize)
+	if len(ips) != defaultSweepSize {
+		t.Fatalf("expected a broad prefix to be capped at %d addresses, got %d", defaultSweepSize, len(ips))
+	}
+}
+
+func TestSweepTaskDuplicateFiltersRepeats(t *testing.T) {
+	r := &sweepTask{filter: boom.NewDefaultStableBloomFilter(sweepFilterSize, sweepFilterFP)}
+
+	if r.duplicate("192.168.1.1") {
+		t.Fatal("first sighting of the address should not be reported as a duplicate")
+	}
+	if !r.duplicate("192.168.1.1") {
+		t.Fatal("second sighting of the same address should be reported as a duplicate")
+	}
+}
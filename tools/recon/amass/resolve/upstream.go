@@ -0,0 +1,366 @@
+// Copyright 2017-2020 Jeff Foley. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package resolve
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// UpstreamStats holds the query/error counters tracked for a single Upstream.
+type UpstreamStats struct {
+	Queries int64
+	Errors  int64
+}
+
+// Upstream is a single configured DNS resolver reachable over UDP, TCP,
+// DNS-over-TLS (RFC 7858), or DNS-over-HTTPS (RFC 8484).
+//
+// Nothing in this source tree constructs a Pool from an Upstream yet: the
+// resolver pool that subdomainTask and fqdnFilter query through (referenced
+// here only as r.enum.Sys.Pool()) is part of the wider Amass resolver
+// package that lives outside this snapshot, and wiring a chosen transport
+// in means changing how that pool is built from config, not anything in
+// upstream.go itself. Until that constructor is reachable from this tree,
+// NewUpstream is exercised only by upstream_test.go.
+type Upstream interface {
+	// Exchange sends msg to the upstream and returns its response.
+	Exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, error)
+	// String identifies the upstream for logging and metrics.
+	String() string
+	// Stats returns the current query/error counters for the upstream.
+	Stats() UpstreamStats
+}
+
+// NewUpstream parses spec and returns the Upstream implementing the
+// transport it names. A bare host[:port] (no scheme) remains plain UDP for
+// backward compatibility. tls:// and https:// upstreams name a hostname that
+// is resolved once against bootstrap (a list of plain-DNS servers) and cached.
+func NewUpstream(spec string, bootstrap []string) (Upstream, error) {
+	scheme, addr := splitUpstreamSpec(spec)
+
+	switch scheme {
+	case "", "udp":
+		u, err := newBasicUpstream(addr, "")
+		return u, err
+	case "tcp":
+		return newBasicUpstream(addr, "tcp")
+	case "tls":
+		host, port := splitHostPort(addr, "853")
+		ip, err := cachedBootstrapIP(host, bootstrap)
+		if err != nil {
+			return nil, err
+		}
+		return newDoTUpstream(host, ip, port), nil
+	case "https":
+		if !validEndpoint(spec) {
+			return nil, fmt.Errorf("resolve: invalid DoH endpoint %q", spec)
+		}
+
+		u, _ := url.Parse(spec)
+		host, port := u.Hostname(), u.Port()
+		if port == "" {
+			port = "443"
+		}
+		ip, err := cachedBootstrapIP(host, bootstrap)
+		if err != nil {
+			return nil, err
+		}
+		return newDoHUpstream(spec, ip, port), nil
+	default:
+		return nil, fmt.Errorf("resolve: unsupported upstream scheme %q", scheme)
+	}
+}
+
+// splitUpstreamSpec separates the scheme from the remainder of an upstream
+// spec, treating a bare host[:port] as having no scheme.
+func splitUpstreamSpec(spec string) (scheme, addr string) {
+	if idx := strings.Index(spec, "://"); idx != -1 {
+		return spec[:idx], spec[idx+3:]
+	}
+	return "", spec
+}
+
+// splitHostPort separates addr into a host and port, falling back to
+// defaultPort when addr carries none.
+func splitHostPort(addr, defaultPort string) (host, port string) {
+	if h, p, err := net.SplitHostPort(addr); err == nil {
+		return h, p
+	}
+	return addr, defaultPort
+}
+
+var bootstrapCache sync.Map // hostname -> resolved IP string
+
+// cachedBootstrapIP resolves host against the bootstrap resolvers (falling
+// back to the system resolver when none are configured), caching the result
+// so repeated lookups of the same DoT/DoH upstream do not repeat the
+// bootstrap query. The original hostname is left to the caller, since it is
+// still needed for TLS certificate verification (SNI).
+func cachedBootstrapIP(host string, bootstrap []string) (string, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return host, nil
+	}
+
+	if cached, found := bootstrapCache.Load(host); found {
+		return cached.(string), nil
+	}
+
+	ip, err := resolveBootstrapHost(host, bootstrap)
+	if err != nil {
+		return "", err
+	}
+
+	bootstrapCache.Store(host, ip)
+	return ip, nil
+}
+
+// resolveBootstrapHost looks up host using the configured plain-DNS bootstrap
+// servers, or the system resolver when none were provided.
+func resolveBootstrapHost(host string, bootstrap []string) (string, error) {
+	if len(bootstrap) == 0 {
+		addrs, err := net.LookupHost(host)
+		if err != nil || len(addrs) == 0 {
+			return "", fmt.Errorf("resolve: failed to bootstrap %s: %w", host, err)
+		}
+		return addrs[0], nil
+	}
+
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(host), dns.TypeA)
+
+	c := new(dns.Client)
+	for _, server := range bootstrap {
+		resp, _, err := c.Exchange(m, net.JoinHostPort(server, "53"))
+		if err != nil || resp == nil {
+			continue
+		}
+		for _, ans := range resp.Answer {
+			if a, ok := ans.(*dns.A); ok {
+				return a.A.String(), nil
+			}
+		}
+	}
+
+	return "", fmt.Errorf("resolve: failed to bootstrap %s using the configured bootstrap servers", host)
+}
+
+// basicUpstream implements Upstream over plain UDP, falling back to TCP when
+// a response is truncated, or exclusively over TCP when net is "tcp".
+type basicUpstream struct {
+	addr  string
+	net   string
+	stats UpstreamStats
+}
+
+func newBasicUpstream(addr, network string) (*basicUpstream, error) {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "53")
+	}
+	return &basicUpstream{addr: addr, net: network}, nil
+}
+
+func (u *basicUpstream) String() string { return u.addr }
+
+func (u *basicUpstream) Stats() UpstreamStats {
+	return UpstreamStats{
+		Queries: atomic.LoadInt64(&u.stats.Queries),
+		Errors:  atomic.LoadInt64(&u.stats.Errors),
+	}
+}
+
+func (u *basicUpstream) Exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	atomic.AddInt64(&u.stats.Queries, 1)
+
+	c := &dns.Client{Net: u.net}
+	resp, _, err := c.ExchangeContext(ctx, msg, u.addr)
+	if err != nil {
+		atomic.AddInt64(&u.stats.Errors, 1)
+		return nil, err
+	}
+
+	// A truncated UDP response must be retried over TCP.
+	if u.net == "" && resp != nil && resp.Truncated {
+		tc := &dns.Client{Net: "tcp"}
+		resp, _, err = tc.ExchangeContext(ctx, msg, u.addr)
+		if err != nil {
+			atomic.AddInt64(&u.stats.Errors, 1)
+			return nil, err
+		}
+	}
+
+	return resp, nil
+}
+
+// dotUpstream implements Upstream over DNS-over-TLS (RFC 7858), keeping a
+// pool of open, keep-alive TLS connections to the upstream.
+type dotUpstream struct {
+	sni   string // original hostname, used for SNI and certificate verification
+	addr  string // host:port actually dialed (the bootstrap-resolved address)
+	pool  sync.Pool
+	stats UpstreamStats
+}
+
+func newDoTUpstream(host, ip, port string) *dotUpstream {
+	u := &dotUpstream{sni: host, addr: net.JoinHostPort(ip, port)}
+	u.pool.New = func() interface{} {
+		tlsConf := &tls.Config{ServerName: u.sni}
+
+		conn, err := tls.DialWithDialer(&net.Dialer{Timeout: 5 * time.Second}, "tcp", u.addr, tlsConf)
+		if err != nil {
+			return nil
+		}
+		return &dns.Conn{Conn: conn}
+	}
+	return u
+}
+
+func (u *dotUpstream) String() string { return "tls://" + u.sni }
+
+func (u *dotUpstream) Stats() UpstreamStats {
+	return UpstreamStats{
+		Queries: atomic.LoadInt64(&u.stats.Queries),
+		Errors:  atomic.LoadInt64(&u.stats.Errors),
+	}
+}
+
+func (u *dotUpstream) Exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	atomic.AddInt64(&u.stats.Queries, 1)
+
+	v := u.pool.Get()
+	conn, ok := v.(*dns.Conn)
+	if !ok || conn == nil {
+		atomic.AddInt64(&u.stats.Errors, 1)
+		return nil, fmt.Errorf("resolve: failed to establish a DoT connection to %s", u.addr)
+	}
+
+	// Connections are kept in a pool and reused across calls, so a deadline
+	// set for one call must not leak into the next: clear it back to the
+	// zero value (no deadline) when this call's context carries none,
+	// otherwise a reused connection could inherit an already-expired one
+	// and fail immediately.
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	} else {
+		conn.SetDeadline(time.Time{})
+	}
+
+	if err := conn.WriteMsg(msg); err != nil {
+		conn.Close()
+		atomic.AddInt64(&u.stats.Errors, 1)
+		return nil, err
+	}
+
+	resp, err := conn.ReadMsg()
+	if err != nil {
+		conn.Close()
+		atomic.AddInt64(&u.stats.Errors, 1)
+		return nil, err
+	}
+
+	// Keep the connection alive for reuse by a later query.
+	u.pool.Put(conn)
+	return resp, nil
+}
+
+// dohUpstream implements Upstream over DNS-over-HTTPS (RFC 8484), issuing
+// application/dns-message POSTs over a shared, HTTP/2-enabled client.
+type dohUpstream struct {
+	endpoint string
+	client   *http.Client
+	stats    UpstreamStats
+}
+
+// newDoHUpstream builds a DoH upstream for endpoint whose underlying TCP
+// connections are pinned to the bootstrap-resolved ip, so the cached
+// bootstrap lookup is actually used instead of being resolved again by
+// net/http on every request. TLS verification and the Host header still use
+// endpoint's original hostname, since only the dial address is overridden.
+func newDoHUpstream(endpoint, ip, port string) *dohUpstream {
+	dialer := &net.Dialer{Timeout: 5 * time.Second}
+
+	return &dohUpstream{
+		endpoint: endpoint,
+		client: &http.Client{
+			Timeout: 10 * time.Second,
+			Transport: &http.Transport{
+				ForceAttemptHTTP2: true,
+				DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+					return dialer.DialContext(ctx, network, net.JoinHostPort(ip, port))
+				},
+			},
+		},
+	}
+}
+
+func (u *dohUpstream) String() string { return u.endpoint }
+
+func (u *dohUpstream) Stats() UpstreamStats {
+	return UpstreamStats{
+		Queries: atomic.LoadInt64(&u.stats.Queries),
+		Errors:  atomic.LoadInt64(&u.stats.Errors),
+	}
+}
+
+func (u *dohUpstream) Exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	atomic.AddInt64(&u.stats.Queries, 1)
+
+	wire, err := msg.Pack()
+	if err != nil {
+		atomic.AddInt64(&u.stats.Errors, 1)
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.endpoint, bytes.NewReader(wire))
+	if err != nil {
+		atomic.AddInt64(&u.stats.Errors, 1)
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+
+	resp, err := u.client.Do(req)
+	if err != nil {
+		atomic.AddInt64(&u.stats.Errors, 1)
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		atomic.AddInt64(&u.stats.Errors, 1)
+		return nil, fmt.Errorf("resolve: DoH request to %s failed with status %d", u.endpoint, resp.StatusCode)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		atomic.AddInt64(&u.stats.Errors, 1)
+		return nil, err
+	}
+
+	out := new(dns.Msg)
+	if err := out.Unpack(body); err != nil {
+		atomic.AddInt64(&u.stats.Errors, 1)
+		return nil, err
+	}
+	return out, nil
+}
+
+// validEndpoint reports whether endpoint parses as an absolute https:// URL,
+// used to validate DoH upstream specs before they are put into service.
+func validEndpoint(endpoint string) bool {
+	u, err := url.Parse(endpoint)
+	return err == nil && u.Scheme == "https" && u.Host != ""
+}
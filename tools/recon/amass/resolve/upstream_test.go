@@ -0,0 +1,67 @@
+// Copyright 2017-2020 Jeff Foley. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package resolve
+
+import "testing"
+
+func TestSplitUpstreamSpec(t *testing.T) {
+	cases := []struct {
+		spec, scheme, addr string
+	}{
+		{"8.8.8.8", "", "8.8.8.8"},
+		{"8.8.8.8:53", "", "8.8.8.8:53"},
+		{"udp://8.8.8.8", "udp", "8.8.8.8"},
+		{"tcp://8.8.8.8:53", "tcp", "8.8.8.8:53"},
+		{"tls://dns.google", "tls", "dns.google"},
+		{"https://dns.google/dns-query", "https", "dns.google/dns-query"},
+	}
+
+	for _, c := range cases {
+		scheme, addr := splitUpstreamSpec(c.spec)
+		if scheme != c.scheme || addr != c.addr {
+			t.Errorf("splitUpstreamSpec(%q) = (%q, %q), want (%q, %q)", c.spec, scheme, addr, c.scheme, c.addr)
+		}
+	}
+}
+
+func TestValidEndpoint(t *testing.T) {
+	valid := []string{"https://dns.google/dns-query", "https://cloudflare-dns.com/dns-query"}
+	invalid := []string{"dns.google/dns-query", "tls://dns.google", "https://"}
+
+	for _, e := range valid {
+		if !validEndpoint(e) {
+			t.Errorf("expected %q to be a valid DoH endpoint", e)
+		}
+	}
+	for _, e := range invalid {
+		if validEndpoint(e) {
+			t.Errorf("expected %q to be an invalid DoH endpoint", e)
+		}
+	}
+}
+
+func TestNewUpstreamBareHostDefaultsToUDP(t *testing.T) {
+	u, err := NewUpstream("8.8.8.8", nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if u.String() != "8.8.8.8:53" {
+		t.Errorf("expected the default port to be appended, got %q", u.String())
+	}
+	if b, ok := u.(*basicUpstream); !ok || b.net != "" {
+		t.Errorf("expected a plain UDP upstream, got %#v", u)
+	}
+}
+
+func TestNewUpstreamRejectsUnknownScheme(t *testing.T) {
+	if _, err := NewUpstream("ftp://8.8.8.8", nil); err == nil {
+		t.Fatal("expected an error for an unsupported upstream scheme")
+	}
+}
+
+func TestNewUpstreamRejectsMalformedDoHEndpoint(t *testing.T) {
+	if _, err := NewUpstream("https://", nil); err == nil {
+		t.Fatal("expected an error for a malformed DoH endpoint")
+	}
+}